@@ -0,0 +1,197 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package certs implements a CertSource which speaks to the Cloud SQL Admin
+// API to create ephemeral certificates for a client to use.
+package certs
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strings"
+
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+)
+
+// NewCertSource returns a CertSource which can be used to authenticate using
+// the Cloud SQL Admin API. The client must be non-nil and is used to make
+// requests to it; a non-empty host overrides the API's base path.
+//
+// If checkRegion is true, the CertSource will verify that the region
+// specified in the instance name matches the region reported by the API.
+func NewCertSource(host string, client *http.Client, checkRegion bool) *CertSource {
+	serv, err := sqladmin.New(client)
+	if err != nil {
+		// This should only happen if NewCertSource is passed a nil client,
+		// which is a programmer error.
+		panic(fmt.Sprintf("certs: failed to create sqladmin client: %v", err))
+	}
+	if host != "" {
+		serv.BasePath = host
+	}
+	return &CertSource{Client: serv, CheckRegion: checkRegion}
+}
+
+// CertSource implements a CertSource that speaks to the Cloud SQL API to
+// create ephemeral certificates.
+type CertSource struct {
+	// Client is used to make authenticated requests to the Cloud SQL Admin
+	// API.
+	Client *sqladmin.Service
+	// CheckRegion is true if the 'region' portion of an instance name
+	// should be validated against the region reported by the Cloud SQL
+	// Admin API.
+	CheckRegion bool
+}
+
+// Local returns a certificate that can be used to authenticate with the
+// given instance. The returned certificate is signed with a key generated
+// on the fly, and the private half is never transmitted.
+func (s *CertSource) Local(instance string) (tls.Certificate, error) {
+	return s.local(instance, "")
+}
+
+// LocalIAM is like Local, but it also sends accessToken - an IAM database
+// authentication login-scoped OAuth2 access token - with the ephemeral
+// certificate request, so the Cloud SQL backend issues a certificate the
+// holder of that token can use to log in as their IAM identity. It
+// implements proxy.IAMCertSource.
+func (s *CertSource) LocalIAM(instance, accessToken string) (tls.Certificate, error) {
+	if accessToken == "" {
+		return tls.Certificate{}, fmt.Errorf("certs: LocalIAM requires a non-empty access token")
+	}
+	return s.local(instance, accessToken)
+}
+
+func (s *CertSource) local(instance, accessToken string) (tls.Certificate, error) {
+	pkix, priv, err := generateCert()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	project, region, name, err := parseInstanceName(instance)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	req := &sqladmin.SslCertsCreateEphemeralRequest{
+		PublicKey: string(pkix),
+	}
+	if accessToken != "" {
+		req.AccessToken = accessToken
+	}
+	resp, err := s.Client.SslCerts.CreateEphemeral(project, name, req).Do()
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("certs: createEphemeral for %q failed: %v", instance, err)
+	}
+
+	if s.CheckRegion {
+		if err := checkRegion(region, resp.Cert); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+
+	certBytes := []byte(resp.Cert)
+	cert, err := tls.X509KeyPair(certBytes, priv)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("certs: parsing ephemeral certificate failed: %v", err)
+	}
+	return cert, nil
+}
+
+// Remote returns the instance's CA certificate, address, name, and database
+// engine version. ipAddrType selects which of the instance's IP addresses to
+// return, matched against the Admin API's ipAddresses[].type ("PRIMARY",
+// "PRIVATE", ...); an empty ipAddrType is treated as "PRIMARY".
+func (s *CertSource) Remote(instance, ipAddrType string) (cert *x509.Certificate, addr, name, version string, err error) {
+	if ipAddrType == "" {
+		ipAddrType = "PRIMARY"
+	}
+
+	project, _, inst, err := parseInstanceName(instance)
+	if err != nil {
+		return nil, "", "", "", err
+	}
+
+	data, err := s.Client.Instances.Get(project, inst).Do()
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("certs: instances.get for %q failed: %v", instance, err)
+	}
+
+	if data.Region == "" {
+		return nil, "", "", "", fmt.Errorf("certs: unexpected empty region for instance %q", instance)
+	}
+
+	for _, ip := range data.IpAddresses {
+		if ip.Type == ipAddrType {
+			addr = ip.IpAddress
+		}
+	}
+	if addr == "" {
+		return nil, "", "", "", fmt.Errorf("certs: no %s IP found for instance %q", ipAddrType, instance)
+	}
+
+	cert, err = parseCert(data.ServerCaCert.Cert)
+	if err != nil {
+		return nil, "", "", "", fmt.Errorf("certs: parsing CA certificate for %q failed: %v", instance, err)
+	}
+	return cert, addr, data.Project + ":" + data.Region + ":" + data.Name, data.DatabaseVersion, nil
+}
+
+func checkRegion(region string, pemCert string) error {
+	cert, err := parseCert(pemCert)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(cert.Subject.CommonName, region) {
+		return fmt.Errorf("certs: expected region %q in certificate common name %q", region, cert.Subject.CommonName)
+	}
+	return nil
+}
+
+func parseCert(pemCert string) (*x509.Certificate, error) {
+	bl, _ := pem.Decode([]byte(pemCert))
+	if bl == nil {
+		return nil, fmt.Errorf("certs: invalid PEM certificate")
+	}
+	return x509.ParseCertificate(bl.Bytes)
+}
+
+func generateCert() (pkix, priv []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, fmt.Errorf("certs: failed to generate key: %v", err)
+	}
+
+	pkix, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("certs: failed to marshal public key: %v", err)
+	}
+
+	priv = x509.MarshalPKCS1PrivateKey(key)
+	return pkix, priv, nil
+}
+
+func parseInstanceName(instance string) (project, region, name string, err error) {
+	parts := strings.Split(instance, ":")
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("certs: invalid instance name %q; expected \"project:region:name\"", instance)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mysql contains a helper for building a *mysql.Config that dials
+// an instance through the proxy, including support for IAM database
+// authentication.
+package mysql
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lingkio/cloudsql-proxy/proxy/proxy"
+	"golang.org/x/net/context"
+)
+
+// Cfg returns a *mysql.Config set up to connect to instance through client,
+// a proxy.Client previously configured with Init, InitClient, or
+// InitWithOptions.
+//
+// If iamAuthN is true, password is ignored and replaced per-connection with
+// a fresh OAuth2 access token from client.IAMToken - client must have been
+// constructed with proxy.WithIAMAuthN(), and user should be the IAM
+// identity's database username (see proxy.Client.IAMIdentity).
+func Cfg(client *proxy.Client, instance, user, password string, iamAuthN bool) *mysql.Config {
+	cfg := mysql.NewConfig()
+	cfg.User = user
+	cfg.Passwd = password
+	cfg.Net = instance
+	cfg.Addr = instance
+	cfg.AllowCleartextPasswords = true
+	cfg.AllowNativePasswords = true
+
+	if iamAuthN {
+		// BeforeConnect runs once per connection against a private clone of
+		// cfg the driver makes for that connection, so setting Passwd here
+		// - unlike in the dial function below - can't race with another
+		// concurrently-opened connection's token.
+		cfg.BeforeConnect = func(ctx context.Context, mc *mysql.Config) error {
+			tok, _, err := client.IAMToken(ctx)
+			if err != nil {
+				return fmt.Errorf("mysql: couldn't mint IAM login token for %q: %v", instance, err)
+			}
+			mc.Passwd = tok
+			return nil
+		}
+	}
+
+	// The go-sql-driver/mysql network name is registered per instance
+	// (not shared) so that concurrently-configured instances don't stomp
+	// on each other's dial function.
+	mysql.RegisterDialContext(instance, func(ctx context.Context, addr string) (net.Conn, error) {
+		return client.Dial(addr)
+	})
+
+	return cfg
+}
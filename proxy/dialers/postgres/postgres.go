@@ -0,0 +1,109 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package postgres contains a helper for building a *sql.DB that dials an
+// instance through the proxy, including support for IAM database
+// authentication.
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/lingkio/cloudsql-proxy/proxy/proxy"
+	"golang.org/x/net/context"
+)
+
+// DialCfg returns a *sql.DB that dials instance through client, a
+// proxy.Client previously configured with Init, InitClient, or
+// InitWithOptions.
+//
+// If iamAuthN is true, password is ignored; instead, every new pooled
+// connection mints a fresh OAuth2 access token from client.IAMToken and
+// sends it as the password - client must have been constructed with
+// proxy.WithIAMAuthN(), and user should be the IAM identity's database
+// username (see proxy.Client.IAMIdentity).
+func DialCfg(client *proxy.Client, instance, user, password, dbname string, iamAuthN bool) *sql.DB {
+	return sql.OpenDB(&connector{
+		client:   client,
+		instance: instance,
+		user:     user,
+		password: password,
+		dbname:   dbname,
+		iamAuthN: iamAuthN,
+	})
+}
+
+// connector implements database/sql/driver.Connector. It builds a fresh
+// lib/pq Connector - and, when iamAuthN is set, a fresh password - for
+// every pooled connection sql.DB opens, since lib/pq bakes its DSN in at
+// pq.NewConnector time and won't otherwise pick up a rotated IAM token.
+type connector struct {
+	client                           *proxy.Client
+	instance, user, password, dbname string
+	iamAuthN                         bool
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	password := c.password
+	if c.iamAuthN {
+		tok, _, err := c.client.IAMToken(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("postgres: couldn't mint IAM login token for %q: %v", c.instance, err)
+		}
+		password = tok
+	}
+
+	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable",
+		pqQuote(c.instance), pqQuote(c.user), pqQuote(password), pqQuote(c.dbname))
+	inner, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("postgres: invalid connection string for %q: %v", c.instance, err)
+	}
+	inner.Dialer(proxyDialer{client: c.client, instance: c.instance})
+	return inner.Connect(ctx)
+}
+
+func (c *connector) Driver() driver.Driver { return pq.Driver{} }
+
+// pqQuote quotes value for use in a libpq keyword=value connection string,
+// escaping backslashes and single quotes, so a value containing a space or
+// an embedded "key=value" pair can't corrupt the DSN or override a later
+// parameter.
+func pqQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// proxyDialer implements pq.Dialer, routing lib/pq's TCP connection through
+// the proxy's Client.Dial instead of dialing the instance's address
+// directly.
+type proxyDialer struct {
+	client   *proxy.Client
+	instance string
+}
+
+func (d proxyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.client.Dial(d.instance)
+}
+
+func (d proxyDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return d.client.Dial(d.instance, proxy.WithDialTimeout(timeout))
+}
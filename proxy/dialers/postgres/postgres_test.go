@@ -0,0 +1,34 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import "testing"
+
+func TestPqQuoteEscapesSpecialChars(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"simple", `'simple'`},
+		{"pass word", `'pass word'`},
+		{"dbname=other", `'dbname=other'`},
+		{`back\slash`, `'back\\slash'`},
+		{`quo'te`, `'quo\'te'`},
+	}
+	for _, tt := range tests {
+		if got := pqQuote(tt.in); got != tt.want {
+			t.Errorf("pqQuote(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// refreshFraction is how far into an ephemeral certificate's remaining TTL
+// the refresh-ahead CertSource waits before proactively fetching its
+// replacement.
+const refreshFraction = 0.8
+
+// MetadataCertSource is implemented by a CertSource that can report an
+// instance's address and current certificate expiry without making a
+// fresh Admin API call, for observability. The default refresh-ahead
+// CertSource implements it; see Client.InstanceMetadata.
+type MetadataCertSource interface {
+	Metadata(instance string) (addr string, certExpiry time.Time, ok bool)
+}
+
+// NewCachingCertSource wraps inner so its ephemeral certificates are
+// fetched once per instance and then proactively refreshed in the
+// background - at refreshFraction of their remaining TTL - instead of
+// synchronously on every Dial. It's the default CertSource installed by
+// Init and InitWithOptions (InitClient uses the given Client's Certs as
+// is); pass WithCertSource(src) to use a
+// different CertSource instead (e.g. in tests, or a cross-process shared
+// cache).
+//
+// Call Client.Close to stop the background refreshers this CertSource
+// starts.
+func NewCachingCertSource(inner CertSource) CertSource {
+	return &refreshAheadCertSource{inner: inner, entries: make(map[string]*cacheEntry)}
+}
+
+type cachedCert struct {
+	cert                tls.Certificate
+	addr, name, version string
+	expiry              time.Time
+}
+
+type cacheEntry struct {
+	mu    sync.RWMutex
+	value cachedCert
+	ready bool
+
+	// loading is non-nil while some goroutine is in the middle of fetching
+	// this entry for the first time; it's closed when that fetch
+	// completes, waking any other callers blocked in Local. See Local.
+	loading chan struct{}
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type refreshAheadCertSource struct {
+	inner CertSource
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+func (s *refreshAheadCertSource) entryFor(instance string) *cacheEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[instance]
+	if !ok {
+		e = &cacheEntry{stop: make(chan struct{})}
+		s.entries[instance] = e
+	}
+	return e
+}
+
+// Local implements CertSource. The first call for a given instance blocks
+// on inner.Local/inner.Remote and starts a background refresher; every
+// later call is served from the cache without touching the Admin API.
+// Concurrent first calls for the same instance (e.g. a connection pool
+// opening several connections at once before anything is cached) share a
+// single fetch and a single refresher instead of each racing to start
+// their own.
+func (s *refreshAheadCertSource) Local(instance string) (tls.Certificate, error) {
+	e := s.entryFor(instance)
+
+	for {
+		e.mu.Lock()
+		if e.ready {
+			cert := e.value.cert
+			e.mu.Unlock()
+			return cert, nil
+		}
+		if e.loading != nil {
+			loading := e.loading
+			e.mu.Unlock()
+			<-loading
+			continue
+		}
+		e.loading = make(chan struct{})
+		e.mu.Unlock()
+		break
+	}
+
+	v, err := s.fetch(instance)
+
+	e.mu.Lock()
+	loading := e.loading
+	e.loading = nil
+	if err == nil {
+		e.value, e.ready = v, true
+	}
+	e.mu.Unlock()
+	close(loading)
+
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	go s.refreshLoop(instance, e)
+	return v.cert, nil
+}
+
+// Remote implements CertSource by delegating directly to inner; the CA
+// certificate and server name rarely change and aren't worth caching on
+// their own. Only ipAddrType "PRIMARY" is ever cached (see fetch), so
+// non-default ip types always take this live path.
+func (s *refreshAheadCertSource) Remote(instance, ipAddrType string) (*x509.Certificate, string, string, string, error) {
+	return s.inner.Remote(instance, ipAddrType)
+}
+
+// cachedRemote is implemented by a CertSource that can serve the addr/name
+// pair it already cached for instance - the same ones Local's background
+// refresher keeps current - without making a live Remote call. Client.refresh
+// uses it so that only the very first Dial for an instance pays for a
+// synchronous Remote round trip.
+type cachedRemote interface {
+	cachedRemote(instance string) (addr, name string, ok bool)
+}
+
+func (s *refreshAheadCertSource) cachedRemote(instance string) (addr, name string, ok bool) {
+	e := s.entryFor(instance)
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.ready {
+		return "", "", false
+	}
+	return e.value.addr, e.value.name, true
+}
+
+// LocalIAM implements proxy.IAMCertSource by delegating directly to inner,
+// uncached: an IAM-scoped certificate is bound to the OAuth2 access token
+// it was requested with, which changes on every refresh, so caching it the
+// way the default path caches Local wouldn't save any Admin API calls.
+func (s *refreshAheadCertSource) LocalIAM(instance, accessToken string) (tls.Certificate, error) {
+	iamSrc, ok := s.inner.(IAMCertSource)
+	if !ok {
+		return tls.Certificate{}, fmt.Errorf("proxy: underlying CertSource %T doesn't support IAM database authentication", s.inner)
+	}
+	return iamSrc.LocalIAM(instance, accessToken)
+}
+
+// Metadata implements MetadataCertSource.
+func (s *refreshAheadCertSource) Metadata(instance string) (addr string, certExpiry time.Time, ok bool) {
+	e := s.entryFor(instance)
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if !e.ready {
+		return "", time.Time{}, false
+	}
+	return e.value.addr, e.value.expiry, true
+}
+
+// Close stops every background refresh goroutine this CertSource started.
+func (s *refreshAheadCertSource) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.entries {
+		e.closeOnce.Do(func() { close(e.stop) })
+	}
+	return nil
+}
+
+func (s *refreshAheadCertSource) fetch(instance string) (cachedCert, error) {
+	cert, err := s.inner.Local(instance)
+	if err != nil {
+		return cachedCert{}, err
+	}
+	_, addr, name, version, err := s.inner.Remote(instance, "PRIMARY")
+	if err != nil {
+		return cachedCert{}, err
+	}
+	expiry, err := certExpiry(cert)
+	if err != nil {
+		return cachedCert{}, err
+	}
+	return cachedCert{cert: cert, addr: addr, name: name, version: version, expiry: expiry}, nil
+}
+
+func (s *refreshAheadCertSource) refreshLoop(instance string, e *cacheEntry) {
+	for {
+		e.mu.RLock()
+		expiry := e.value.expiry
+		e.mu.RUnlock()
+
+		wait := time.Duration(float64(time.Until(expiry)) * refreshFraction)
+		if wait < time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		next, err := s.fetch(instance)
+		if err != nil {
+			// The stale cert keeps being served (Local doesn't check its
+			// expiry, so this holds even past it); just try again shortly.
+			select {
+			case <-e.stop:
+				return
+			case <-time.After(30 * time.Second):
+			}
+			continue
+		}
+		e.mu.Lock()
+		e.value = next
+		e.mu.Unlock()
+	}
+}
+
+// certExpiry reads the NotAfter time from cert's leaf certificate.
+func certExpiry(cert tls.Certificate) (time.Time, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf.NotAfter, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return time.Time{}, fmt.Errorf("proxy: certificate has no leaf to read an expiry from")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("proxy: couldn't parse certificate to read its expiry: %v", err)
+	}
+	return leaf.NotAfter, nil
+}
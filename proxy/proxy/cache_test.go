@@ -0,0 +1,78 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingCertSource is a CertSource whose Local calls take a moment (to
+// widen the window for a race) and whose Local/Remote count how many times each was
+// invoked, so tests can assert on the number of Admin API round trips a
+// cache makes.
+type countingCertSource struct {
+	localCalls  int32
+	remoteCalls int32
+}
+
+func (s *countingCertSource) Local(instance string) (tls.Certificate, error) {
+	atomic.AddInt32(&s.localCalls, 1)
+	time.Sleep(10 * time.Millisecond)
+	return tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}}, nil
+}
+
+func (s *countingCertSource) Remote(instance, ipAddrType string) (*x509.Certificate, string, string, string, error) {
+	atomic.AddInt32(&s.remoteCalls, 1)
+	return nil, "203.0.113.1", "project:region:" + instance, "POSTGRES", nil
+}
+
+func TestRefreshAheadCertSourceDedupsConcurrentFirstFetch(t *testing.T) {
+	inner := &countingCertSource{}
+	src := NewCachingCertSource(inner).(*refreshAheadCertSource)
+	defer src.Close()
+
+	const callers = 10
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			if _, err := src.Local("proj:region:inst"); err != nil {
+				t.Errorf("Local: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&inner.localCalls); got != 1 {
+		t.Errorf("inner.Local called %d times, want 1", got)
+	}
+	if got := atomic.LoadInt32(&inner.remoteCalls); got != 1 {
+		t.Errorf("inner.Remote called %d times, want 1", got)
+	}
+
+	addr, name, ok := src.cachedRemote("proj:region:inst")
+	if !ok {
+		t.Fatal("cachedRemote returned ok=false after Local populated the cache")
+	}
+	if addr != "203.0.113.1" || name != "project:region:proj:region:inst" {
+		t.Errorf("cachedRemote = (%q, %q), want (%q, %q)", addr, name, "203.0.113.1", "project:region:proj:region:inst")
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/lingkio/cloudsql-proxy/proxy/certs"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/impersonate"
+)
+
+var defaultScopes = []string{"https://www.googleapis.com/auth/sqlservice.admin"}
+
+// Option configures how InitWithOptions obtains credentials for talking to
+// the Cloud SQL Admin API. Options are applied in the order they're passed;
+// the result of the last one assigning a given field wins.
+type Option func(*clientConfig)
+
+type clientConfig struct {
+	credentialsJSON      []byte
+	credentialsFile      string
+	tokenSource          oauth2.TokenSource
+	credentials          *google.Credentials
+	impersonateTarget    string
+	impersonateDelegates []string
+	scopes               []string
+}
+
+// WithCredentialsJSON returns an Option that uses the given service account
+// or authorized user JSON to authenticate.
+func WithCredentialsJSON(b []byte) Option {
+	return func(cfg *clientConfig) { cfg.credentialsJSON = b }
+}
+
+// WithCredentialsFile returns an Option that reads service account or
+// authorized user JSON from the given file to authenticate.
+func WithCredentialsFile(filename string) Option {
+	return func(cfg *clientConfig) { cfg.credentialsFile = filename }
+}
+
+// WithTokenSource returns an Option that uses the given oauth2.TokenSource
+// directly, bypassing credential discovery entirely.
+func WithTokenSource(ts oauth2.TokenSource) Option {
+	return func(cfg *clientConfig) { cfg.tokenSource = ts }
+}
+
+// WithCredentials returns an Option that uses an already-resolved
+// *google.Credentials, e.g. one obtained from google.FindDefaultCredentials.
+func WithCredentials(creds *google.Credentials) Option {
+	return func(cfg *clientConfig) { cfg.credentials = creds }
+}
+
+// WithImpersonatedServiceAccount returns an Option that impersonates the
+// service account identified by email, optionally delegating through the
+// given chain of intermediate service accounts. The impersonation call is
+// always made with application default credentials; credentials supplied by
+// another Option are not used to impersonate, and only feed the cache key.
+func WithImpersonatedServiceAccount(email string, delegates []string) Option {
+	return func(cfg *clientConfig) {
+		cfg.impersonateTarget = email
+		cfg.impersonateDelegates = delegates
+	}
+}
+
+// WithScopes returns an Option that overrides the default
+// sqlservice.admin OAuth2 scope.
+func WithScopes(scopes ...string) Option {
+	return func(cfg *clientConfig) { cfg.scopes = scopes }
+}
+
+// resolve resolves the clientConfig down to a single oauth2.TokenSource and
+// a stable identity, in the form of bytes suitable for hashing into a
+// dialClient cache key, that two equivalent configurations will agree on
+// regardless of which Option was used to supply the underlying credential.
+func (cfg *clientConfig) resolve(ctx context.Context) (oauth2.TokenSource, []byte, error) {
+	scopes := cfg.scopes
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	var ts oauth2.TokenSource
+	var identity []byte
+	switch {
+	case cfg.credentials != nil:
+		ts = cfg.credentials.TokenSource
+		identity = cfg.credentials.JSON
+		if len(identity) == 0 {
+			// google.FindDefaultCredentials leaves JSON nil for GCE/Cloud
+			// Run metadata ADC, and a caller may construct a
+			// *google.Credentials with no JSON at all - fall back to a
+			// pointer-based identity so two distinct credentials with no
+			// JSON don't collide in cacheKey and share a Client.
+			identity = []byte(fmt.Sprintf("credentials:%p", cfg.credentials))
+		}
+	case cfg.tokenSource != nil:
+		ts = cfg.tokenSource
+		identity = []byte(fmt.Sprintf("tokensource:%p", cfg.tokenSource))
+	case cfg.credentialsJSON != nil:
+		creds, err := google.CredentialsFromJSON(ctx, cfg.credentialsJSON, scopes...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy: invalid credentials JSON: %v", err)
+		}
+		ts = creds.TokenSource
+		identity = cfg.credentialsJSON
+	case cfg.credentialsFile != "":
+		b, err := ioutil.ReadFile(cfg.credentialsFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy: couldn't read credentials file %q: %v", cfg.credentialsFile, err)
+		}
+		creds, err := google.CredentialsFromJSON(ctx, b, scopes...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy: invalid credentials in %q: %v", cfg.credentialsFile, err)
+		}
+		ts = creds.TokenSource
+		identity = b
+	default:
+		creds, err := google.FindDefaultCredentials(ctx, scopes...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy: couldn't find default credentials: %v", err)
+		}
+		ts = creds.TokenSource
+		identity = creds.JSON
+	}
+
+	if cfg.impersonateTarget != "" {
+		its, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: cfg.impersonateTarget,
+			Scopes:          scopes,
+			Delegates:       cfg.impersonateDelegates,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("proxy: couldn't impersonate %q: %v", cfg.impersonateTarget, err)
+		}
+		ts = its
+		identity = append(append([]byte(nil), identity...), []byte("impersonate:"+cfg.impersonateTarget)...)
+	}
+
+	return ts, identity, nil
+}
+
+// cacheKey returns the stable dialClient map key for this configuration. It
+// hashes the resolved credential identity (rather than, say, the address of
+// an oauth2.TokenSource) so that the same underlying credentials arriving
+// via different Options - or via the legacy credential_json string - hash to
+// the same Client and get deduplicated.
+func cacheKey(identity []byte) string {
+	sum := sha256.Sum256(identity)
+	return hex.EncodeToString(sum[:])
+}
+
+// InitWithOptions builds a Client from explicitly supplied credentials
+// rather than a JSON string parsed as a JWT config. It accepts Google
+// API-style options such as WithCredentialsJSON, WithCredentialsFile,
+// WithTokenSource, WithCredentials, and WithImpersonatedServiceAccount.
+//
+// The returned Client can be used directly via Client.Dial. It is also
+// registered in the same cache package-level Dial consults, keyed by a
+// stable hash of the resolved credentials, so a later Dial call using
+// equivalent credentials (however they're supplied) reuses it.
+func InitWithOptions(ctx context.Context, opts ...Option) (*Client, error) {
+	cfg := &clientConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	ts, identity, err := cfg.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(identity)
+
+	dialClient.Lock()
+	defer dialClient.Unlock()
+	if dialClient.c == nil {
+		dialClient.c = make(map[string]*Client)
+	}
+	if c, ok := dialClient.c[key]; ok {
+		return c, nil
+	}
+
+	c := &Client{
+		Port:  port,
+		Certs: NewCachingCertSource(certs.NewCertSource("https://www.googleapis.com/sql/v1beta4/", oauth2.NewClient(ctx, ts), true)),
+	}
+	// Best-effort: derive a login-scoped token source and service account
+	// email for IAM database authentication; see WithIAMAuthN. When
+	// impersonation is in play, identity is no longer the raw JSON
+	// iamDefaultsFromJSON expects (resolve appends "impersonate:<target>"
+	// to it), so derive the IAM token source from the impersonation config
+	// directly instead, mirroring how resolve built the admin one above.
+	if cfg.impersonateTarget != "" {
+		if iamTS, email, err := iamDefaultsFromImpersonation(ctx, cfg.impersonateTarget, cfg.impersonateDelegates); err == nil {
+			withIAMDefaults(iamTS, email)(c)
+		}
+	} else if iamTS, email, err := iamDefaultsFromJSON(ctx, identity); err == nil {
+		withIAMDefaults(iamTS, email)(c)
+	}
+	dialClient.c[key] = c
+	return c, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+func TestCacheKeyStableForEqualIdentity(t *testing.T) {
+	a := cacheKey([]byte(`{"type":"service_account"}`))
+	b := cacheKey([]byte(`{"type":"service_account"}`))
+	if a != b {
+		t.Errorf("cacheKey not stable: %q != %q", a, b)
+	}
+}
+
+func TestCacheKeyDiffersForDifferentIdentity(t *testing.T) {
+	a := cacheKey([]byte(`{"type":"service_account","id":1}`))
+	b := cacheKey([]byte(`{"type":"service_account","id":2}`))
+	if a == b {
+		t.Errorf("cacheKey collided for different identities: both %q", a)
+	}
+}
+
+func TestClientConfigResolveUsesExplicitCredentialsJSON(t *testing.T) {
+	// An "authorized_user" credential's TokenSource is lazy - building it
+	// via google.CredentialsFromJSON only parses these fields, it doesn't
+	// make a network call - so resolve can run against this without a real
+	// refresh token.
+	authorizedUserJSON := []byte(`{"type":"authorized_user","client_id":"id","client_secret":"secret","refresh_token":"refresh"}`)
+	cfg := &clientConfig{credentialsJSON: authorizedUserJSON}
+
+	_, id1, err := cfg.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	_, id2, err := cfg.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	// On the credentialsJSON path, the identity bytes cacheKey hashes
+	// should be the raw JSON the caller supplied - not some other field -
+	// so two callers who pass the same credentialsJSON land on the same
+	// Client.
+	if cacheKey(id1) != cacheKey(id2) {
+		t.Errorf("resolve produced different identities for the same *clientConfig across calls: %q != %q", id1, id2)
+	}
+	if cacheKey(id1) != cacheKey(authorizedUserJSON) {
+		t.Errorf("resolve's identity for the credentialsJSON path wasn't the raw JSON supplied: %q", id1)
+	}
+}
+
+func TestClientConfigResolveTokenSourceIdentityIsStable(t *testing.T) {
+	ts := &fakeTokenSource{}
+	cfg := &clientConfig{tokenSource: ts}
+
+	_, id1, err := cfg.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	_, id2, err := cfg.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if cacheKey(id1) != cacheKey(id2) {
+		t.Errorf("resolve produced different identities for the same *clientConfig across calls: %q != %q", id1, id2)
+	}
+}
+
+func TestClientConfigResolveCredentialsWithoutJSONDontCollide(t *testing.T) {
+	// google.Credentials.JSON is nil for GCE/Cloud Run metadata ADC and for
+	// a caller-constructed *google.Credentials{TokenSource: ts}; two
+	// distinct credentials in that shape must still resolve to different
+	// identities so InitWithOptions doesn't hand one tenant's cached
+	// *Client to another.
+	a := &google.Credentials{TokenSource: &fakeTokenSource{}}
+	b := &google.Credentials{TokenSource: &fakeTokenSource{}}
+
+	_, idA, err := (&clientConfig{credentials: a}).resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	_, idB, err := (&clientConfig{credentials: b}).resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if cacheKey(idA) == cacheKey(idB) {
+		t.Errorf("resolve gave two distinct empty-JSON *google.Credentials the same identity: %q", idA)
+	}
+
+	// But the same *google.Credentials resolved twice must still agree
+	// with itself, the same way the tokenSource path does.
+	_, idA2, err := (&clientConfig{credentials: a}).resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	if cacheKey(idA) != cacheKey(idA2) {
+		t.Errorf("resolve produced different identities for the same *google.Credentials across calls: %q != %q", idA, idA2)
+	}
+}
+
+type fakeTokenSource struct{}
+
+func (*fakeTokenSource) Token() (*oauth2.Token, error) { return &oauth2.Token{}, nil }
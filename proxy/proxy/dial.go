@@ -38,49 +38,58 @@ var dialClient struct {
 //
 // If one of the Init functions hasn't been called yet, InitDefault is called.
 //
+// Trailing DialOptions override, for this call only, any defaults the
+// Client was constructed with (see DialerOption).
+//
 // This is a network-level function; consider looking in the dialers
 // subdirectory for more convenience functions related to actually logging into
 // your database.
-func Dial(instance string, credential_json string) (net.Conn, error) {
+func Dial(instance string, credential_json string, opts ...DialOption) (net.Conn, error) {
+	key := cacheKey([]byte(credential_json))
 	dialClient.Lock()
 	if dialClient.c == nil {
 		dialClient.c = make(map[string]*Client)
 	}
-	c := dialClient.c[credential_json]
+	c := dialClient.c[key]
 	dialClient.Unlock()
 	if c == nil {
 		if err := InitFromJson(context.Background(), credential_json); err != nil {
 			return nil, fmt.Errorf("default proxy initialization failed; consider calling proxy.Init explicitly: %v", err)
 		}
-		// InitDefault initialized the client.
+		// InitFromJson initialized the client.
 		dialClient.Lock()
-		c = dialClient.c[credential_json]
+		c = dialClient.c[key]
 		dialClient.Unlock()
 	}
 
-	return c.Dial(instance)
+	return c.Dial(instance, opts...)
 }
 
-// Dialer is a convenience type to model the standard 'Dial' function.
-type Dialer func(net, addr string) (net.Conn, error)
-
 // Init must be called before Dial is called. This is a more flexible version
 // of InitDefault, but allows you to set more fields.
 //
 // The http.Client is used to authenticate API requests.
 // The connset parameter is optional.
 // If the dialer is nil, net.Conn is used.
-func Init(auth *http.Client, connset *ConnSet, dialer Dialer, credential_json string) {
+//
+// Any DialerOptions passed establish the defaults every subsequent Dial to
+// this credential_json applies, e.g. Init(auth, nil, nil, credential_json,
+// WithDefaultIPType(PrivateIP)).
+func Init(auth *http.Client, connset *ConnSet, dialer Dialer, credential_json string, opts ...DialerOption) {
 	dialClient.Lock()
 	if dialClient.c == nil {
 		dialClient.c = make(map[string]*Client)
 	}
-	dialClient.c[credential_json] = &Client{
+	c := &Client{
 		Port:   port,
-		Certs:  certs.NewCertSource("https://www.googleapis.com/sql/v1beta4/", auth, true),
+		Certs:  NewCachingCertSource(certs.NewCertSource("https://www.googleapis.com/sql/v1beta4/", auth, true)),
 		Conns:  connset,
 		Dialer: dialer,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	dialClient.c[cacheKey([]byte(credential_json))] = c
 	dialClient.Unlock()
 }
 
@@ -88,7 +97,10 @@ func Init(auth *http.Client, connset *ConnSet, dialer Dialer, credential_json st
 // directly.
 func InitClient(c Client, credential_json string) {
 	dialClient.Lock()
-	dialClient.c[credential_json] = &c
+	if dialClient.c == nil {
+		dialClient.c = make(map[string]*Client)
+	}
+	dialClient.c[cacheKey([]byte(credential_json))] = &c
 	dialClient.Unlock()
 }
 
@@ -99,7 +111,11 @@ func InitDefault(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	Init(cl, nil, nil, "")
+	var iamOpts []DialerOption
+	if ts, email, err := iamDefaultsFromADC(ctx); err == nil {
+		iamOpts = append(iamOpts, withIAMDefaults(ts, email))
+	}
+	Init(cl, nil, nil, "", iamOpts...)
 	return nil
 }
 
@@ -110,6 +126,10 @@ func InitFromJson(ctx context.Context, credential_json string) error {
 		return err
 	}
 	client := cfg.Client(ctx)
-	Init(client, nil, nil, credential_json)
+	var iamOpts []DialerOption
+	if ts, email, err := iamDefaultsFromJSON(ctx, []byte(credential_json)); err == nil {
+		iamOpts = append(iamOpts, withIAMDefaults(ts, email))
+	}
+	Init(client, nil, nil, credential_json, iamOpts...)
 	return nil
 }
@@ -0,0 +1,153 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import "time"
+
+// IPType selects which of an instance's IP addresses Dial should connect
+// to.
+type IPType int
+
+const (
+	// PublicIP connects to the instance's public IP address. This is the
+	// default.
+	PublicIP IPType = iota
+	// PrivateIP connects to the instance's private IP address. The
+	// caller is responsible for ensuring a network path to the private
+	// IP exists, e.g. via VPC peering or a VPN.
+	PrivateIP
+)
+
+// String returns a short label for ipType, suitable for use as a telemetry
+// attribute value.
+func (ipType IPType) String() string {
+	if ipType == PrivateIP {
+		return "private"
+	}
+	return "public"
+}
+
+// adminType returns the Cloud SQL Admin API ipAddresses[].type value this
+// IPType selects, for passing to CertSource.Remote.
+func (ipType IPType) adminType() string {
+	if ipType == PrivateIP {
+		return "PRIVATE"
+	}
+	return "PRIMARY"
+}
+
+const (
+	defaultDialTimeout    = 30 * time.Second
+	defaultTCPKeepAlive   = 30 * time.Second
+	defaultRefreshTimeout = 60 * time.Second
+)
+
+// dialCfg holds the per-Dial settings a DialOption mutates. It is seeded
+// from the Client's defaults (set via DialerOption) before the DialOptions
+// passed to Dial are applied.
+type dialCfg struct {
+	ipType         IPType
+	dialTimeout    time.Duration
+	tcpKeepAlive   time.Duration
+	refreshTimeout time.Duration
+}
+
+func (c *Client) newDialCfg() dialCfg {
+	return dialCfg{
+		ipType:         c.defaultIPType,
+		dialTimeout:    durationOrDefault(c.defaultDialTimeout, defaultDialTimeout),
+		tcpKeepAlive:   durationOrDefault(c.defaultTCPKeepAlive, defaultTCPKeepAlive),
+		refreshTimeout: durationOrDefault(c.defaultRefreshTimeout, defaultRefreshTimeout),
+	}
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+// DialOption configures a single call to Client.Dial (or the package-level
+// Dial). Options passed to Dial take precedence over any defaults
+// established by a DialerOption at construction time.
+type DialOption func(*dialCfg)
+
+// WithIPType selects whether Dial connects over the instance's public or
+// private IP address.
+func WithIPType(ipType IPType) DialOption {
+	return func(cfg *dialCfg) { cfg.ipType = ipType }
+}
+
+// WithDialTimeout bounds how long Dial waits for the TCP connection to the
+// instance to complete. It only applies when the Client is using the
+// default dialer (Client.Dialer is nil); a caller-supplied Dialer is
+// responsible for enforcing its own timeout.
+func WithDialTimeout(d time.Duration) DialOption {
+	return func(cfg *dialCfg) { cfg.dialTimeout = d }
+}
+
+// WithTCPKeepAlive sets the TCP keepalive period on the connection Dial
+// returns.
+func WithTCPKeepAlive(d time.Duration) DialOption {
+	return func(cfg *dialCfg) { cfg.tcpKeepAlive = d }
+}
+
+// WithRefreshTimeout bounds how long Dial waits on an ephemeral certificate
+// refresh (the pair of Admin API calls in Client.refresh) before giving up
+// and returning an error.
+func WithRefreshTimeout(d time.Duration) DialOption {
+	return func(cfg *dialCfg) { cfg.refreshTimeout = d }
+}
+
+// DialerOption configures the defaults a Client applies to every Dial call
+// that doesn't override them with a DialOption. Init applies the
+// DialerOptions passed to it at construction time; InitClient and
+// InitWithOptions take none.
+type DialerOption func(*Client)
+
+// WithDefaultIPType sets the IP type Dial uses unless overridden per call
+// by WithIPType.
+func WithDefaultIPType(ipType IPType) DialerOption {
+	return func(c *Client) { c.defaultIPType = ipType }
+}
+
+// WithDefaultDialTimeout sets the dial timeout Dial uses unless overridden
+// per call by WithDialTimeout.
+func WithDefaultDialTimeout(d time.Duration) DialerOption {
+	return func(c *Client) { c.defaultDialTimeout = d }
+}
+
+// WithDefaultTCPKeepAlive sets the TCP keepalive period Dial uses unless
+// overridden per call by WithTCPKeepAlive.
+func WithDefaultTCPKeepAlive(d time.Duration) DialerOption {
+	return func(c *Client) { c.defaultTCPKeepAlive = d }
+}
+
+// WithDefaultRefreshTimeout sets the cert refresh timeout Dial uses unless
+// overridden per call by WithRefreshTimeout.
+func WithDefaultRefreshTimeout(d time.Duration) DialerOption {
+	return func(c *Client) { c.defaultRefreshTimeout = d }
+}
+
+// WithCertSource overrides the Client's CertSource, replacing the default
+// refresh-ahead cache installed by Init and InitWithOptions.
+// Use it to supply a CertSource tailored to tests, an on-disk cert cache,
+// or a cache shared across processes. The given src is used as-is; wrap it
+// in NewCachingCertSource first if it should also be refreshed ahead of
+// expiry in the background.
+func WithCertSource(src CertSource) DialerOption {
+	return func(c *Client) { c.Certs = src }
+}
@@ -0,0 +1,77 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDialOptionsOverrideDialerDefaults(t *testing.T) {
+	c := &Client{}
+	WithDefaultIPType(PrivateIP)(c)
+	WithDefaultDialTimeout(5 * time.Second)(c)
+	WithDefaultRefreshTimeout(10 * time.Second)(c)
+
+	cfg := c.newDialCfg()
+	if cfg.ipType != PrivateIP {
+		t.Errorf("ipType = %v, want %v", cfg.ipType, PrivateIP)
+	}
+	if cfg.dialTimeout != 5*time.Second {
+		t.Errorf("dialTimeout = %v, want %v", cfg.dialTimeout, 5*time.Second)
+	}
+	if cfg.refreshTimeout != 10*time.Second {
+		t.Errorf("refreshTimeout = %v, want %v", cfg.refreshTimeout, 10*time.Second)
+	}
+
+	for _, opt := range []DialOption{
+		WithIPType(PublicIP),
+		WithDialTimeout(time.Second),
+		WithRefreshTimeout(2 * time.Second),
+	} {
+		opt(&cfg)
+	}
+	if cfg.ipType != PublicIP {
+		t.Errorf("after DialOptions, ipType = %v, want %v", cfg.ipType, PublicIP)
+	}
+	if cfg.dialTimeout != time.Second {
+		t.Errorf("after DialOptions, dialTimeout = %v, want %v", cfg.dialTimeout, time.Second)
+	}
+	if cfg.refreshTimeout != 2*time.Second {
+		t.Errorf("after DialOptions, refreshTimeout = %v, want %v", cfg.refreshTimeout, 2*time.Second)
+	}
+}
+
+func TestNewDialCfgFillsInZeroDefaults(t *testing.T) {
+	cfg := (&Client{}).newDialCfg()
+	if cfg.dialTimeout != defaultDialTimeout {
+		t.Errorf("dialTimeout = %v, want %v", cfg.dialTimeout, defaultDialTimeout)
+	}
+	if cfg.tcpKeepAlive != defaultTCPKeepAlive {
+		t.Errorf("tcpKeepAlive = %v, want %v", cfg.tcpKeepAlive, defaultTCPKeepAlive)
+	}
+	if cfg.refreshTimeout != defaultRefreshTimeout {
+		t.Errorf("refreshTimeout = %v, want %v", cfg.refreshTimeout, defaultRefreshTimeout)
+	}
+}
+
+func TestIPTypeAdminType(t *testing.T) {
+	if got := PublicIP.adminType(); got != "PRIMARY" {
+		t.Errorf("PublicIP.adminType() = %q, want %q", got, "PRIMARY")
+	}
+	if got := PrivateIP.adminType(); got != "PRIVATE" {
+		t.Errorf("PrivateIP.adminType() = %q, want %q", got, "PRIVATE")
+	}
+}
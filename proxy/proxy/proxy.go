@@ -0,0 +1,335 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+
+	"github.com/lingkio/cloudsql-proxy/proxy/telemetry"
+)
+
+// CertSource is how a Client obtains the ephemeral client certificate and
+// the CA certificate/address of the instance it is dialing. The default
+// implementation, certs.NewCertSource, talks to the Cloud SQL Admin API.
+type CertSource interface {
+	// Local returns a certificate that can be used to authenticate with
+	// the given instance.
+	Local(instance string) (tls.Certificate, error)
+	// Remote returns the instance's CA certificate, address, name, and
+	// database engine version. ipAddrType selects which of the instance's
+	// IP addresses to return, using the Cloud SQL Admin API's ipAddresses[]
+	// "type" values ("PRIMARY", "PRIVATE", ...); a CertSource that doesn't
+	// support more than the instance's primary address may ignore it.
+	Remote(instance, ipAddrType string) (cert *x509.Certificate, addr, name, version string, err error)
+}
+
+// ConnSet tracks the net.Conns associated with the instances a Client has
+// dialed, keyed by instance connection name. It exists so that callers
+// (such as the proxy CLI) can enumerate or forcibly close open connections.
+type ConnSet struct {
+	mu    sync.Mutex
+	conns map[string]map[net.Conn]string
+}
+
+// NewConnSet returns a ConnSet ready for use.
+func NewConnSet() *ConnSet {
+	return &ConnSet{conns: make(map[string]map[net.Conn]string)}
+}
+
+// Add registers conn as belonging to instance.
+func (c *ConnSet) Add(instance string, conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[string]map[net.Conn]string)
+	}
+	m, ok := c.conns[instance]
+	if !ok {
+		m = make(map[net.Conn]string)
+		c.conns[instance] = m
+	}
+	m[conn] = conn.RemoteAddr().String()
+}
+
+// Remove unregisters conn from instance.
+func (c *ConnSet) Remove(instance string, conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m, ok := c.conns[instance]; ok {
+		delete(m, conn)
+		if len(m) == 0 {
+			delete(c.conns, instance)
+		}
+	}
+}
+
+// Dialer is a convenience type to model the standard 'Dial' function.
+type Dialer func(net, addr string) (net.Conn, error)
+
+// Client is the orchestrator of the proxy's dialing logic. A Client holds
+// everything needed to turn an instance connection name into a net.Conn:
+// where to get certificates (Certs), how to open the underlying TCP socket
+// (Dialer), and the port Cloud SQL listens on.
+type Client struct {
+	// Port is the port to connect to on the remote instance.
+	Port int
+	// MaxConnections is the maximum number of connections a Client may
+	// establish. A value of zero means no limit.
+	MaxConnections uint64
+	// Certs provides the TLS material used to authenticate with an
+	// instance.
+	Certs CertSource
+	// Conns, if non-nil, tracks open connections so callers can enumerate
+	// or close them.
+	Conns *ConnSet
+	// Dialer is used to create the underlying net.Conn. If nil, net.Dial
+	// is used.
+	Dialer Dialer
+
+	// defaultIPType, defaultDialTimeout, defaultTCPKeepAlive, and
+	// defaultRefreshTimeout hold the per-Dial defaults established via
+	// DialerOption at construction time; see options.go.
+	defaultIPType         IPType
+	defaultDialTimeout    time.Duration
+	defaultTCPKeepAlive   time.Duration
+	defaultRefreshTimeout time.Duration
+
+	// iamAuthN, iamTokenSource, and iamIdentity back IAM database
+	// authentication; see iam.go.
+	iamAuthN       bool
+	iamTokenSource oauth2.TokenSource
+	iamIdentity    string
+
+	connCount uint64
+}
+
+// Dial returns a net.Conn connected to the specified Cloud SQL instance. The
+// format of 'instance' is "project-name:region:instance-name".
+//
+// By default Dial uses the defaults established for this Client at
+// construction time (see DialerOption). Callers may override any of them
+// for this call only by passing DialOptions, e.g.:
+//
+//	conn, err := client.Dial(instance, proxy.WithIPType(proxy.PrivateIP))
+func (c *Client) Dial(instance string, opts ...DialOption) (net.Conn, error) {
+	cfg := c.newDialCfg()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return c.dialWithCfg(instance, cfg)
+}
+
+// Close releases resources held by this Client's CertSource, such as the
+// background refresh goroutines started by the default cache installed by
+// Init and InitWithOptions (see NewCachingCertSource). It does
+// not close any connections already returned by Dial.
+func (c *Client) Close() error {
+	if closer, ok := c.Certs.(interface{ Close() error }); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// InstanceMetadata reports what this Client currently knows about instance:
+// its IP address and the expiry of the ephemeral certificate cached for it.
+// It's for observability only; dialing doesn't require calling it first. If
+// the CertSource hasn't cached anything for instance yet (e.g. Dial hasn't
+// been called for it), ok is false.
+func (c *Client) InstanceMetadata(instance string) (addr string, certExpiry time.Time, ok bool) {
+	m, supported := c.Certs.(MetadataCertSource)
+	if !supported {
+		return "", time.Time{}, false
+	}
+	return m.Metadata(instance)
+}
+
+func (c *Client) dialWithCfg(instance string, cfg dialCfg) (net.Conn, error) {
+	start := time.Now()
+	ctx, span := telemetry.StartSpan(context.Background(), "cloudsql.googleapi.Dial", map[string]string{
+		"instance": instance,
+		"ip_type":  cfg.ipType.String(),
+	})
+	defer func() {
+		telemetry.RecordDialLatency(instance, time.Since(start))
+		span.End()
+	}()
+
+	conn, err := c.dialWithCfgTraced(ctx, instance, cfg)
+	if err != nil {
+		span.SetError(err)
+	}
+	return conn, err
+}
+
+// refresh fetches a fresh ephemeral client certificate and the instance's
+// CA certificate/address/server name for ipType, wrapping the pair of Admin
+// API calls in a single "cloudsql.googleapi.Refresh" span and reporting
+// their latency and any failure to the installed telemetry.Recorder. If
+// refreshTimeout is positive and the fetch doesn't complete in time, refresh
+// returns an error without waiting for it further; the fetch itself keeps
+// running in the background and still populates the cache for later calls.
+func (c *Client) refresh(ctx context.Context, instance string, ipType IPType, refreshTimeout time.Duration) (cert tls.Certificate, addr, name string, err error) {
+	start := time.Now()
+	_, span := telemetry.StartSpan(ctx, "cloudsql.googleapi.Refresh", map[string]string{"instance": instance})
+	defer func() {
+		telemetry.RecordRefreshLatency(instance, time.Since(start))
+		if err != nil {
+			telemetry.RecordRefreshFailure(instance)
+			span.SetError(err)
+		}
+		span.End()
+	}()
+
+	type result struct {
+		cert       tls.Certificate
+		addr, name string
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		cert, addr, name, err := c.doRefresh(instance, ipType)
+		done <- result{cert, addr, name, err}
+	}()
+
+	var timeout <-chan time.Time
+	if refreshTimeout > 0 {
+		timeout = time.After(refreshTimeout)
+	}
+	select {
+	case r := <-done:
+		return r.cert, r.addr, r.name, r.err
+	case <-timeout:
+		return tls.Certificate{}, "", "", fmt.Errorf("proxy: refresh for %q timed out after %v", instance, refreshTimeout)
+	}
+}
+
+// doRefresh does the actual work of refresh: fetching a fresh client
+// certificate and the instance's CA certificate/address/server name for
+// ipType. It's split out so refresh can bound it with a timeout.
+func (c *Client) doRefresh(instance string, ipType IPType) (cert tls.Certificate, addr, name string, err error) {
+	cert, err = c.localCert(instance)
+	if err != nil {
+		return tls.Certificate{}, "", "", fmt.Errorf("proxy: couldn't get certificate for %q: %v", instance, err)
+	}
+
+	if ipType == PublicIP {
+		// When localCert above went through the caching CertSource's Local,
+		// it already populated the cache's addr/name for instance (the
+		// cache fetches both together, but only ever for the default/public
+		// address; the IAM path's LocalIAM is uncached and populates
+		// nothing); prefer that over a redundant,
+		// synchronous Remote call so only the very first Dial for instance
+		// ever blocks on one.
+		if cr, ok := c.Certs.(cachedRemote); ok {
+			if cachedAddr, cachedName, ok := cr.cachedRemote(instance); ok {
+				return cert, cachedAddr, cachedName, nil
+			}
+		}
+	}
+
+	_, addr, name, _, err = c.Certs.Remote(instance, ipType.adminType())
+	if err != nil {
+		return tls.Certificate{}, "", "", fmt.Errorf("proxy: couldn't get remote address for %q: %v", instance, err)
+	}
+	return cert, addr, name, nil
+}
+
+func (c *Client) dialWithCfgTraced(ctx context.Context, instance string, cfg dialCfg) (net.Conn, error) {
+	if c.MaxConnections != 0 && atomic.LoadUint64(&c.connCount) >= c.MaxConnections {
+		return nil, fmt.Errorf("proxy: too many open connections (max %d)", c.MaxConnections)
+	}
+
+	tlsCert, addr, name, err := c.refresh(ctx, instance, cfg.ipType, cfg.refreshTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	_, connectSpan := telemetry.StartSpan(ctx, "cloudsql.googleapi.Connect", map[string]string{"instance": instance})
+	defer connectSpan.End()
+
+	dialer := c.Dialer
+	if dialer == nil {
+		dialer = (&net.Dialer{Timeout: cfg.dialTimeout}).Dial
+	}
+
+	addrPort := fmt.Sprintf("%s:%d", addr, c.Port)
+	conn, err := dialer("tcp", addrPort)
+	if err != nil {
+		connectSpan.SetError(err)
+		return nil, fmt.Errorf("proxy: couldn't connect to %q (%q): %v", instance, addrPort, err)
+	}
+
+	type keepAliver interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(d time.Duration) error
+	}
+	if ka, ok := conn.(keepAliver); ok && cfg.tcpKeepAlive > 0 {
+		ka.SetKeepAlive(true)
+		ka.SetKeepAlivePeriod(cfg.tcpKeepAlive)
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         name,
+		Certificates:       []tls.Certificate{tlsCert},
+		InsecureSkipVerify: true,
+	}
+	ret := tls.Client(conn, tlsConfig)
+
+	if c.Conns != nil {
+		c.Conns.Add(instance, ret)
+	}
+	atomic.AddUint64(&c.connCount, 1)
+	telemetry.RecordOpenConnections(instance, 1)
+	return &instrumentedConn{Conn: ret, client: c, instance: instance}, nil
+}
+
+// instrumentedConn wraps the TLS connection returned from a Dial so the
+// Client can decrement its open connection count, untrack it from Conns,
+// and report its byte counters to telemetry on Close.
+type instrumentedConn struct {
+	net.Conn
+	client   *Client
+	instance string
+}
+
+func (c *instrumentedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	telemetry.RecordBytes(c.instance, int64(n), 0)
+	return n, err
+}
+
+func (c *instrumentedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	telemetry.RecordBytes(c.instance, 0, int64(n))
+	return n, err
+}
+
+func (c *instrumentedConn) Close() error {
+	if c.client.Conns != nil {
+		c.client.Conns.Remove(c.instance, c.Conn)
+	}
+	atomic.AddUint64(&c.client.connCount, ^uint64(0))
+	telemetry.RecordOpenConnections(c.instance, -1)
+	return c.Conn.Close()
+}
@@ -0,0 +1,61 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import "github.com/lingkio/cloudsql-proxy/proxy/telemetry"
+
+// TelemetryOption configures InitTelemetry.
+type TelemetryOption func(*telemetryConfig)
+
+type telemetryConfig struct {
+	tracer   telemetry.Tracer
+	recorder telemetry.Recorder
+}
+
+// WithTracer returns a TelemetryOption that installs t as the Tracer every
+// Client uses around Dial, Refresh, and Connect spans.
+func WithTracer(t telemetry.Tracer) TelemetryOption {
+	return func(cfg *telemetryConfig) { cfg.tracer = t }
+}
+
+// WithRecorder returns a TelemetryOption that installs r as the Recorder
+// every Client reports dial/refresh latency, failures, and connection and
+// byte counts to.
+func WithRecorder(r telemetry.Recorder) TelemetryOption {
+	return func(cfg *telemetryConfig) { cfg.recorder = r }
+}
+
+// InitTelemetry opts every Client in this process into tracing and metrics
+// around Dial, Refresh (certificate generation), and Connect. Without
+// calling InitTelemetry, the proxy emits no telemetry and pays no cost for
+// it: the proxy module doesn't hard-depend on OpenCensus or
+// OpenTelemetry, only on the no-op default in package telemetry.
+//
+// To opt in, build a Tracer from whichever you use - e.g.
+// telemetry.NewOTelTracer("cloudsql-proxy") when built with `-tags otel`,
+// or telemetry.NewOpenCensusTracer() with `-tags opencensus` - and pass it
+// via WithTracer (and similarly WithRecorder for metrics).
+func InitTelemetry(opts ...TelemetryOption) {
+	cfg := &telemetryConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.tracer != nil {
+		telemetry.SetTracer(cfg.tracer)
+	}
+	if cfg.recorder != nil {
+		telemetry.SetRecorder(cfg.recorder)
+	}
+}
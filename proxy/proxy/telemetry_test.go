@@ -0,0 +1,164 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lingkio/cloudsql-proxy/proxy/telemetry"
+	"golang.org/x/net/context"
+)
+
+// fakeSpan is a telemetry.Span test double that records whether it was
+// ended and with what error, if any.
+type fakeSpan struct {
+	ended bool
+	err   error
+}
+
+func (s *fakeSpan) End()               { s.ended = true }
+func (s *fakeSpan) SetError(err error) { s.err = err }
+
+type spanCall struct {
+	name  string
+	attrs map[string]string
+}
+
+// fakeTracer is a telemetry.Tracer test double that records every span it
+// was asked to start, in order.
+type fakeTracer struct {
+	calls []spanCall
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, telemetry.Span) {
+	t.calls = append(t.calls, spanCall{name, attrs})
+	s := &fakeSpan{}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+type recorderCall struct {
+	method   string
+	instance string
+}
+
+// fakeRecorder is a telemetry.Recorder test double that records which
+// RecordXxx methods were called and for which instance.
+type fakeRecorder struct {
+	calls []recorderCall
+}
+
+func (r *fakeRecorder) RecordDialLatency(instance string, d time.Duration) {
+	r.calls = append(r.calls, recorderCall{"DialLatency", instance})
+}
+
+func (r *fakeRecorder) RecordRefreshLatency(instance string, d time.Duration) {
+	r.calls = append(r.calls, recorderCall{"RefreshLatency", instance})
+}
+
+func (r *fakeRecorder) RecordRefreshFailure(instance string) {
+	r.calls = append(r.calls, recorderCall{"RefreshFailure", instance})
+}
+
+func (r *fakeRecorder) RecordOpenConnections(instance string, delta int64) {
+	r.calls = append(r.calls, recorderCall{"OpenConnections", instance})
+}
+
+func (r *fakeRecorder) RecordBytes(instance string, read, written int64) {
+	r.calls = append(r.calls, recorderCall{"Bytes", instance})
+}
+
+// fakeDialCertSource is a CertSource that returns a usable, already-expired
+// certificate and a fixed address without talking to any Admin API, so Dial
+// can run against it without a network.
+type fakeDialCertSource struct{}
+
+func (fakeDialCertSource) Local(instance string) (tls.Certificate, error) {
+	return tls.Certificate{Leaf: &x509.Certificate{}}, nil
+}
+
+func (fakeDialCertSource) Remote(instance, ipAddrType string) (*x509.Certificate, string, string, string, error) {
+	return nil, "203.0.113.1", "server-name", "POSTGRES", nil
+}
+
+func TestClientDialEmitsTelemetrySpansAndMetrics(t *testing.T) {
+	tr := &fakeTracer{}
+	rec := &fakeRecorder{}
+	telemetry.SetTracer(tr)
+	telemetry.SetRecorder(rec)
+	defer telemetry.SetTracer(nil)
+	defer telemetry.SetRecorder(nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	c := &Client{
+		Port:  3307,
+		Certs: fakeDialCertSource{},
+		Dialer: func(network, addr string) (net.Conn, error) {
+			return clientConn, nil
+		},
+	}
+
+	conn, err := c.Dial("proj:region:inst")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	wantSpans := []string{"cloudsql.googleapi.Dial", "cloudsql.googleapi.Refresh", "cloudsql.googleapi.Connect"}
+	if len(tr.calls) != len(wantSpans) {
+		t.Fatalf("got %d spans %+v, want %d: %v", len(tr.calls), tr.calls, len(wantSpans), wantSpans)
+	}
+	for i, want := range wantSpans {
+		if tr.calls[i].name != want {
+			t.Errorf("span %d = %q, want %q", i, tr.calls[i].name, want)
+		}
+	}
+
+	dialAttrs := tr.calls[0].attrs
+	if dialAttrs["instance"] != "proj:region:inst" || dialAttrs["ip_type"] != "public" {
+		t.Errorf("Dial span attrs = %+v, want instance=proj:region:inst ip_type=public", dialAttrs)
+	}
+
+	for i, s := range tr.spans {
+		if !s.ended {
+			t.Errorf("span %d (%s) was never ended", i, tr.calls[i].name)
+		}
+	}
+
+	var sawDialLatency, sawRefreshLatency, sawOpenConnections bool
+	for _, call := range rec.calls {
+		if call.instance != "proj:region:inst" {
+			t.Errorf("recorder call %+v for unexpected instance", call)
+		}
+		switch call.method {
+		case "DialLatency":
+			sawDialLatency = true
+		case "RefreshLatency":
+			sawRefreshLatency = true
+		case "OpenConnections":
+			sawOpenConnections = true
+		}
+	}
+	if !sawDialLatency || !sawRefreshLatency || !sawOpenConnections {
+		t.Errorf("missing expected recorder calls, got: %+v", rec.calls)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package telemetry
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End()           {}
+func (noopSpan) SetError(error) {}
+
+type noopRecorder struct{}
+
+func (noopRecorder) RecordDialLatency(string, time.Duration)    {}
+func (noopRecorder) RecordRefreshLatency(string, time.Duration) {}
+func (noopRecorder) RecordRefreshFailure(string)                {}
+func (noopRecorder) RecordOpenConnections(string, int64)        {}
+func (noopRecorder) RecordBytes(string, int64, int64)           {}
@@ -0,0 +1,53 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build opencensus
+
+package telemetry
+
+import (
+	"golang.org/x/net/context"
+
+	"go.opencensus.io/trace"
+)
+
+// NewOpenCensusTracer returns a Tracer backed by OpenCensus's default
+// exporter pipeline. It's only available when the binary is built with
+// `-tags opencensus`, so otherwise the proxy module never pulls in
+// go.opencensus.io.
+func NewOpenCensusTracer() Tracer {
+	return ocTracer{}
+}
+
+type ocTracer struct{}
+
+func (ocTracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span) {
+	ctx, span := trace.StartSpan(ctx, name)
+	for k, v := range attrs {
+		span.AddAttributes(trace.StringAttribute(k, v))
+	}
+	return ctx, ocSpan{span: span}
+}
+
+type ocSpan struct {
+	span *trace.Span
+}
+
+func (s ocSpan) End() { s.span.End() }
+
+func (s ocSpan) SetError(err error) {
+	if err != nil {
+		s.span.SetStatus(trace.Status{Code: int32(trace.StatusCodeUnknown), Message: err.Error()})
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package telemetry decouples the proxy's instrumentation from any
+// particular tracing or metrics backend. By default every hook is a no-op,
+// so neither OpenCensus nor OpenTelemetry is a hard dependency of the
+// proxy module; a caller opts in by installing a Tracer and/or Recorder
+// (see SetTracer, SetRecorder), typically via proxy.InitTelemetry.
+//
+// Backend-specific implementations live in otel.go and opencensus.go,
+// guarded by the `otel` and `opencensus` build tags respectively, so
+// picking one doesn't pull the other's dependencies into the build.
+package telemetry
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Span is a single unit of traced work, created by Tracer.Start and closed
+// by calling End.
+type Span interface {
+	// End marks the span as complete.
+	End()
+	// SetError records that the operation the span covers failed.
+	SetError(err error)
+}
+
+// Tracer creates spans around the proxy's Dial, Refresh, and Connect
+// operations.
+type Tracer interface {
+	// Start begins a new span named name, with the given attributes, as
+	// a child of any span already present in ctx. It returns a derived
+	// context carrying the new span, and the Span itself so the caller
+	// can End it.
+	Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span)
+}
+
+// Recorder records the proxy's operational metrics: latencies, failures,
+// and connection/byte counts, each broken down by instance connection
+// name.
+type Recorder interface {
+	RecordDialLatency(instance string, d time.Duration)
+	RecordRefreshLatency(instance string, d time.Duration)
+	RecordRefreshFailure(instance string)
+	RecordOpenConnections(instance string, delta int64)
+	RecordBytes(instance string, read, written int64)
+}
+
+// mu guards tracer and recorder: SetTracer/SetRecorder can be called
+// concurrently with the Start/RecordXxx calls every Dial and refresh make,
+// e.g. a Client dialing at startup while InitTelemetry installs exporters
+// once they're ready.
+var (
+	mu       sync.RWMutex
+	tracer   Tracer   = noopTracer{}
+	recorder Recorder = noopRecorder{}
+)
+
+// SetTracer installs t as the package-wide Tracer used by every Client.
+// Passing nil restores the no-op default.
+func SetTracer(t Tracer) {
+	if t == nil {
+		t = noopTracer{}
+	}
+	mu.Lock()
+	tracer = t
+	mu.Unlock()
+}
+
+// SetRecorder installs r as the package-wide Recorder used by every
+// Client. Passing nil restores the no-op default.
+func SetRecorder(r Recorder) {
+	if r == nil {
+		r = noopRecorder{}
+	}
+	mu.Lock()
+	recorder = r
+	mu.Unlock()
+}
+
+// StartSpan starts a span on the installed Tracer. It's always safe to
+// call, even if no Tracer has been installed.
+func StartSpan(ctx context.Context, name string, attrs map[string]string) (context.Context, Span) {
+	mu.RLock()
+	t := tracer
+	mu.RUnlock()
+	return t.Start(ctx, name, attrs)
+}
+
+// RecordDialLatency reports how long a Dial call took for instance.
+func RecordDialLatency(instance string, d time.Duration) {
+	mu.RLock()
+	r := recorder
+	mu.RUnlock()
+	r.RecordDialLatency(instance, d)
+}
+
+// RecordRefreshLatency reports how long an ephemeral certificate refresh
+// took for instance.
+func RecordRefreshLatency(instance string, d time.Duration) {
+	mu.RLock()
+	r := recorder
+	mu.RUnlock()
+	r.RecordRefreshLatency(instance, d)
+}
+
+// RecordRefreshFailure reports that an ephemeral certificate refresh
+// failed for instance.
+func RecordRefreshFailure(instance string) {
+	mu.RLock()
+	r := recorder
+	mu.RUnlock()
+	r.RecordRefreshFailure(instance)
+}
+
+// RecordOpenConnections adjusts the open connection count for instance by
+// delta (positive on open, negative on close).
+func RecordOpenConnections(instance string, delta int64) {
+	mu.RLock()
+	r := recorder
+	mu.RUnlock()
+	r.RecordOpenConnections(instance, delta)
+}
+
+// RecordBytes reports bytes read from and written to instance since the
+// last report.
+func RecordBytes(instance string, read, written int64) {
+	mu.RLock()
+	r := recorder
+	mu.RUnlock()
+	r.RecordBytes(instance, read, written)
+}